@@ -0,0 +1,59 @@
+package servicediscovery
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheEntry holds either a positive answer (value) or, for negative
+// caching, the error the original lookup failed with. Exactly one of the
+// two is meaningful, depending on how the entry was stored.
+type cacheEntry struct {
+	value     interface{}
+	err       error
+	expiresAt time.Time
+}
+
+// ttlCache is a concurrency-safe cache keyed by DNS name whose entries
+// expire according to the TTL they were stored with, so a re-registered
+// Consul service stops resolving to a stale answer once its records age
+// out rather than being cached forever.
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: make(map[string]cacheEntry)}
+}
+
+// get returns the cached value or error for key, and ok=false if there is
+// no entry or it has expired.
+func (c *ttlCache) get(key string) (value interface{}, err error, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.entries[key]
+	if !found {
+		return nil, nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, nil, false
+	}
+	return entry.value, entry.err, true
+}
+
+// set stores value (or err, for negative caching) under key for the given
+// ttl. A ttl <= 0 stores nothing, since such an entry would already be
+// expired.
+func (c *ttlCache) set(key string, value interface{}, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = cacheEntry{value: value, err: err, expiresAt: time.Now().Add(ttl)}
+}
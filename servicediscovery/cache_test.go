@@ -0,0 +1,77 @@
+package servicediscovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLCache_SetAndGet(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := newTTLCache()
+	testSubject.set("key", "value", nil, time.Minute)
+
+	value, err, ok := testSubject.get("key")
+
+	a.True(ok)
+	a.Equal("value", value)
+	a.NoError(err)
+}
+
+func TestTTLCache_GetMissing(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := newTTLCache()
+
+	value, err, ok := testSubject.get("key")
+
+	a.False(ok)
+	a.Nil(value)
+	a.NoError(err)
+}
+
+func TestTTLCache_NegativeCaching(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := newTTLCache()
+	testSubject.set("key", nil, fmt.Errorf("NXDOMAIN"), time.Minute)
+
+	value, err, ok := testSubject.get("key")
+
+	a.True(ok)
+	a.Nil(value)
+	a.EqualError(err, "NXDOMAIN")
+}
+
+func TestTTLCache_ZeroOrNegativeTTLIsNotStored(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := newTTLCache()
+	testSubject.set("key", "value", nil, 0)
+	testSubject.set("other", "value", nil, -time.Second)
+
+	_, _, ok := testSubject.get("key")
+	a.False(ok)
+
+	_, _, ok = testSubject.get("other")
+	a.False(ok)
+}
+
+func TestTTLCache_EntryExpiresAfterTTL(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := newTTLCache()
+	testSubject.set("key", "value", nil, 10*time.Millisecond)
+
+	value, _, ok := testSubject.get("key")
+	a.True(ok)
+	a.Equal("value", value)
+
+	time.Sleep(20 * time.Millisecond)
+
+	_, _, ok = testSubject.get("key")
+	a.False(ok, "entry should have expired and been evicted")
+}
@@ -0,0 +1,77 @@
+package servicediscovery
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	log "github.com/Sirupsen/logrus"
+)
+
+// QueryMode selects the FQDN format DiscoverServiceWithTag queries
+// Consul's DNS interface with.
+type QueryMode int
+
+const (
+	// QueryModeStandard builds Consul's plain tag-filtered FQDN,
+	// "tag.service.consul" (the default).
+	QueryModeStandard QueryMode = iota
+	// QueryModeRFC2782 builds Consul's RFC 2782 style FQDN instead,
+	// "_service._tag._tcp.service.consul".
+	QueryModeRFC2782
+)
+
+// WithQueryMode overrides the FQDN format DiscoverServiceWithTag uses.
+func WithQueryMode(mode QueryMode) Option {
+	return func(s *serviceDiscovery) {
+		s.queryMode = mode
+	}
+}
+
+// DiscoverServiceWithTag behaves like DiscoverService, but restricts the
+// lookup to instances registered under tag, via Consul's tag-filtered DNS
+// interface ("tag.service.consul"). Under QueryModeRFC2782, it instead
+// issues the RFC 2782 style query ("_service._tag._tcp.service.consul").
+func (s *serviceDiscovery) DiscoverServiceWithTag(service string, tag string) (ip string, port string, err error) {
+	if s.queryMode == QueryModeRFC2782 {
+		return s.DiscoverServiceRFC2782(service, tag, "tcp")
+	}
+	return s.discoverServiceFQDN(dns.Fqdn(tag + "." + service + s.dnsSearch))
+}
+
+// DiscoverServiceRFC2782 behaves like DiscoverService, but queries
+// Consul's RFC 2782 style service/tag/protocol-filtered DNS interface
+// directly: "_service._tag._proto.service.consul".
+func (s *serviceDiscovery) DiscoverServiceRFC2782(service string, tag string, proto string) (ip string, port string, err error) {
+	return s.discoverServiceFQDN(dns.Fqdn(fmt.Sprintf("_%s._%s._%s%s", service, tag, proto, s.dnsSearch)))
+}
+
+// discoverServiceFQDN is DiscoverService, parameterised by an
+// already-built FQDN instead of a bare service name plus s.dnsSearch, so
+// the tag- and RFC 2782-filtered lookups above can reuse the same
+// failover, priority/weight selection and target resolution.
+func (s *serviceDiscovery) discoverServiceFQDN(fqdn string) (ip string, port string, err error) {
+
+	servers := s.rotatedServers()
+
+	groups, _, err := s.lookupSRVForFQDN(fqdn, func(m *dns.Msg) (*dns.Msg, error) {
+		return s.exchangeWithFailover(servers, func(server string) (*dns.Msg, error) {
+			r, _, err := s.client.Exchange(m, server)
+			return r, err
+		})
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, group := range groups {
+		for _, srv := range weightedSRVOrder(group) {
+			target := srv.Target[:len(srv.Target) - 1]
+			targetIp, err := s.resolveTarget(servers, target)
+			if err == nil {
+				return targetIp.String(), fmt.Sprintf("%d", srv.Port), nil
+			}
+		}
+	}
+
+	log.WithField("serviceName", fqdn).Error("Service lookup: No SRV entry in DNS response")
+	return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
+}
@@ -0,0 +1,204 @@
+package servicediscovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// qnameMatcher matches an outbound *dns.Msg by its question's name, so
+// tests can check which FQDN a tag-filtered lookup queries.
+type qnameMatcher struct {
+	qname string
+}
+
+func forQname(qname string) gomock.Matcher {
+	return qnameMatcher{qname: qname}
+}
+
+func (m qnameMatcher) Matches(x interface{}) bool {
+	msg, ok := x.(*dns.Msg)
+	return ok && len(msg.Question) == 1 && msg.Question[0].Name == m.qname
+}
+
+func (m qnameMatcher) String() string {
+	return "is a query for " + m.qname
+}
+
+func TestServiceDiscovery_DiscoverServiceWithTag(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      ".service.consul",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: a "tag.service.consul" style query
+	srvCall := mockDnsClient.EXPECT().Exchange(forQname("canary.serviceName.service.consul."), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverServiceWithTag("serviceName", "canary")
+
+	// then
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_DiscoverServiceWithTag_RFC2782Mode(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject configured for RFC 2782 style queries
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      ".service.consul",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL,
+		queryMode:      QueryModeRFC2782}
+
+	// expect: a "_serviceName._canary._tcp.service.consul" style query
+	srvCall := mockDnsClient.EXPECT().Exchange(forQname("_serviceName._canary._tcp.service.consul."), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverServiceWithTag("serviceName", "canary")
+
+	// then
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_DiscoverServiceRFC2782(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      ".service.consul",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverServiceRFC2782("serviceName", "canary", "udp")
+
+	// then
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_DiscoverAllServiceInstances_ParsesNodeMeta(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: the SRV response carries the target's node metadata as TXT
+	// records in the Additional section
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		},
+		Extra: []dns.RR{
+			&dns.TXT{
+				Hdr: dns.RR_Header{Name: "hostname1."},
+				Txt: []string{"datacenter=dc1", "version=1.2.3"}},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	// when
+	instances, err := testSubject.DiscoverAllServiceInstances("serviceName")
+
+	// then the node metadata is exposed on the instance
+	a.NoError(err)
+	a.Len(instances, 1)
+	a.Equal(map[string]string{"datacenter": "dc1", "version": "1.2.3"}, instances[0].Meta)
+}
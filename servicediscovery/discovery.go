@@ -1,29 +1,121 @@
 package servicediscovery
 
 import (
+	"context"
 	"github.com/miekg/dns"
 	log "github.com/Sirupsen/logrus"
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-type consulServiceDiscovery struct {
-	dnsServer string
+// edns0BufferSize is advertised on every outbound query via an EDNS0 OPT
+// record so the server can reply with more than the legacy 512-byte UDP
+// payload, avoiding a truncated response and the TCP retry it triggers.
+const edns0BufferSize = 4096
+
+// defaultMaxNegativeTTL bounds how long an NXDOMAIN or empty answer is
+// cached even if the authoritative SOA advertises a longer minimum, so a
+// misconfigured zone can't wedge a service as "absent" for too long.
+const defaultMaxNegativeTTL = 30 * time.Second
+
+// Option configures optional behaviour of a serviceDiscovery created via
+// NewServiceDiscovery or NewConsulServiceDiscovery.
+type Option func(*serviceDiscovery)
+
+// WithMaxNegativeTTL overrides how long NXDOMAIN / empty answers are
+// cached, capping whatever the authoritative SOA's minimum TTL advertises.
+func WithMaxNegativeTTL(ttl time.Duration) Option {
+	return func(s *serviceDiscovery) {
+		s.maxNegativeTTL = ttl
+	}
+}
+
+// PreferIPv6 makes resolveTarget prefer a target's AAAA record over its A
+// record whenever both exist. AAAA is always used when it is the only
+// family that resolved, regardless of this option.
+func PreferIPv6() Option {
+	return func(s *serviceDiscovery) {
+		s.preferIPv6 = true
+	}
+}
+
+type serviceDiscovery struct {
+	servers []string
+	nextServer uint32
 	dnsSearch string
 	client DnsClient
-	targetCache map[string]net.IP
+	tcpClient DnsClient
+	targetCache *ttlCache
+	srvCache *ttlCache
+	maxNegativeTTL time.Duration
+	preferIPv6 bool
+	queryMode QueryMode
 }
 
-func NewConsulServiceDiscovery(dnsServer string) (ServiceDiscovery, error) {
+// NewServiceDiscovery builds a ServiceDiscovery that looks up SRV/A/AAAA
+// records under dnsSearch against the given DNS servers (host:port). A
+// server given as a hostname is resolved to every address it returns, not
+// just the first, so all of them are tried on failover.
+func NewServiceDiscovery(dnsServers []string, dnsSearch string, opts ...Option) (ServiceDiscovery, error) {
 
-	host, port, err := net.SplitHostPort(dnsServer)
+	servers, err := resolveServers(dnsServers)
 	if err != nil {
 		return nil, err
 	}
 
-	// If it is not an IP address try to resolve the DNS name.
-	// This is used for local development.
-	if net.ParseIP(host) == nil {
+	ret := serviceDiscovery{
+		servers: servers,
+		dnsSearch: dnsSearch,
+		client: &dns.Client{},
+		tcpClient: &dns.Client{Net: "tcp"},
+		targetCache: newTTLCache(),
+		srvCache: newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	for _, opt := range opts {
+		opt(&ret)
+	}
+
+	return &ret, nil
+}
+
+// NewConsulServiceDiscovery builds a ConsulServiceDiscovery pre-configured
+// for Consul's ".service.consul" DNS interface.
+func NewConsulServiceDiscovery(dnsServers []string, opts ...Option) (ConsulServiceDiscovery, error) {
+	sd, err := NewServiceDiscovery(dnsServers, ".service.consul", opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sd.(*serviceDiscovery), nil
+}
+
+// resolveServers turns each host:port in dnsServers into one or more
+// concrete host:port addresses, resolving hostnames to every address they
+// have (used for local development, and to pick up all of a Consul
+// cluster's agents behind a single DNS name).
+func resolveServers(dnsServers []string) ([]string, error) {
+
+	if len(dnsServers) == 0 {
+		return nil, fmt.Errorf("No service discovery host given")
+	}
+
+	var servers []string
+	for _, dnsServer := range dnsServers {
+		host, port, err := net.SplitHostPort(dnsServer)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) != nil {
+			servers = append(servers, dnsServer)
+			continue
+		}
+
 		addrs, err := net.LookupHost(host)
 		if err != nil {
 			return nil, err
@@ -32,85 +124,533 @@ func NewConsulServiceDiscovery(dnsServer string) (ServiceDiscovery, error) {
 			log.WithField("host", host).Error("No service discovery host could be resolved")
 			return nil, fmt.Errorf("No service discovery host could be resolved")
 		}
-		dnsServer = net.JoinHostPort(addrs[0], port)
+		for _, addr := range addrs {
+			servers = append(servers, net.JoinHostPort(addr, port))
+		}
 	}
 
-	ret := consulServiceDiscovery{
-		dnsServer: dnsServer,
-		dnsSearch: ".service.consul",
-		client: &dns.Client{},
-		targetCache: make(map[string]net.IP)}
-	return &ret, nil
+	return servers, nil
 }
 
-func (s *consulServiceDiscovery) DiscoverService(serviceName string) (ip string, port string, err error) {
+func (s *serviceDiscovery) DiscoverService(serviceName string) (ip string, port string, err error) {
+
+	servers := s.rotatedServers()
+
+	fqdn, groups, _, err := s.lookupSRVByPriority(servers, serviceName)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, group := range groups {
+		for _, srv := range weightedSRVOrder(group) {
+			target := srv.Target[:len(srv.Target) - 1]
+			targetIp, err := s.resolveTarget(servers, target)
+			if err == nil {
+				return targetIp.String(), fmt.Sprintf("%d", srv.Port), nil
+			}
+		}
+	}
+
+	log.WithField("serviceName", fqdn).Error("Service lookup: No SRV entry in DNS response")
+	return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
+}
+
+func (s *serviceDiscovery) DiscoverAllServiceInstances(serviceName string) (instances []ServiceInstance, err error) {
+
+	servers := s.rotatedServers()
+
+	fqdn, groups, meta, err := s.lookupSRVByPriority(servers, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		for _, srv := range weightedSRVOrder(group) {
+			target := srv.Target[:len(srv.Target) - 1]
+			targetIp, err := s.resolveTarget(servers, target)
+			if err != nil {
+				continue
+			}
+			instances = append(instances, ServiceInstance{
+				Host: target,
+				IP: targetIp,
+				Port: srv.Port,
+				Priority: srv.Priority,
+				Weight: srv.Weight,
+				Meta: meta[srv.Target]})
+		}
+	}
+
+	if len(instances) == 0 {
+		log.WithField("serviceName", fqdn).Error("Service lookup: No SRV entry in DNS response")
+		return nil, fmt.Errorf("Service lookup: No SRV entry in DNS response")
+	}
+
+	return instances, nil
+}
+
+func (s *serviceDiscovery) DiscoverServiceContext(ctx context.Context, serviceName string) (ip string, port string, err error) {
+
+	servers := s.rotatedServers()
+
+	fqdn, groups, _, err := s.lookupSRVByPriorityContext(ctx, servers, serviceName)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, group := range groups {
+		for _, srv := range weightedSRVOrder(group) {
+			target := srv.Target[:len(srv.Target) - 1]
+			targetIp, err := s.resolveTargetContext(ctx, servers, target)
+			if err == nil {
+				return targetIp.String(), fmt.Sprintf("%d", srv.Port), nil
+			}
+		}
+	}
+
+	log.WithField("serviceName", fqdn).Error("Service lookup: No SRV entry in DNS response")
+	return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
+}
+
+func (s *serviceDiscovery) DiscoverAllServiceInstancesContext(ctx context.Context, serviceName string) (instances []ServiceInstance, err error) {
+
+	servers := s.rotatedServers()
+
+	fqdn, groups, meta, err := s.lookupSRVByPriorityContext(ctx, servers, serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		for _, srv := range weightedSRVOrder(group) {
+			target := srv.Target[:len(srv.Target) - 1]
+			targetIp, err := s.resolveTargetContext(ctx, servers, target)
+			if err != nil {
+				continue
+			}
+			instances = append(instances, ServiceInstance{
+				Host: target,
+				IP: targetIp,
+				Port: srv.Port,
+				Priority: srv.Priority,
+				Weight: srv.Weight,
+				Meta: meta[srv.Target]})
+		}
+	}
+
+	if len(instances) == 0 {
+		log.WithField("serviceName", fqdn).Error("Service lookup: No SRV entry in DNS response")
+		return nil, fmt.Errorf("Service lookup: No SRV entry in DNS response")
+	}
+
+	return instances, nil
+}
+
+// lookupSRVByPriority resolves the SRV records for serviceName against
+// servers (in the order given, so callers control the failover/rotation
+// order), honouring s.srvCache, and groups them by priority, lowest
+// first, as required by RFC 2782 section 4. meta holds any node-metadata
+// TXT records from the response's Additional section, keyed by the SRV
+// target they describe.
+func (s *serviceDiscovery) lookupSRVByPriority(servers []string, serviceName string) (fqdn string, groups [][]*dns.SRV, meta map[string]map[string]string, err error) {
+	fqdn = dns.Fqdn(serviceName + s.dnsSearch)
+	groups, meta, err = s.lookupSRVForFQDN(fqdn, func(m *dns.Msg) (*dns.Msg, error) {
+		return s.exchangeWithFailover(servers, func(server string) (*dns.Msg, error) {
+			r, _, err := s.client.Exchange(m, server)
+			return r, err
+		})
+	})
+	return fqdn, groups, meta, err
+}
+
+// lookupSRVByPriorityContext is the context.Context-aware counterpart of
+// lookupSRVByPriority: it adds an EDNS0 OPT record to the outbound query
+// and automatically retries over TCP if the UDP response comes back
+// truncated.
+func (s *serviceDiscovery) lookupSRVByPriorityContext(ctx context.Context, servers []string, serviceName string) (fqdn string, groups [][]*dns.SRV, meta map[string]map[string]string, err error) {
+	fqdn = dns.Fqdn(serviceName + s.dnsSearch)
+	groups, meta, err = s.lookupSRVForFQDN(fqdn, func(m *dns.Msg) (*dns.Msg, error) {
+		return s.exchangeWithFailover(servers, func(server string) (*dns.Msg, error) {
+			return s.exchangeContext(ctx, m, server)
+		})
+	})
+	return fqdn, groups, meta, err
+}
+
+// srvAnswer is what gets cached in s.srvCache for a successful SRV lookup:
+// the raw records (re-grouped by priority on every read, since weighted
+// selection re-randomizes each time) plus any node metadata alongside them.
+type srvAnswer struct {
+	records []*dns.SRV
+	meta    map[string]map[string]string
+}
+
+// lookupSRVForFQDN resolves the SRV records for the already-built fqdn,
+// honouring s.srvCache, and groups them by priority, lowest first, as
+// required by RFC 2782 section 4.
+func (s *serviceDiscovery) lookupSRVForFQDN(fqdn string, exchange func(*dns.Msg) (*dns.Msg, error)) (groups [][]*dns.SRV, meta map[string]map[string]string, err error) {
+
+	if cached, cachedErr, ok := s.srvCache.get(fqdn); ok {
+		if cachedErr != nil {
+			return nil, nil, cachedErr
+		}
+		answer := cached.(srvAnswer)
+		return groupSRVByPriority(answer.records), answer.meta, nil
+	}
 
 	m := new(dns.Msg)
-	fqdn := dns.Fqdn(serviceName + s.dnsSearch)
 	m.SetQuestion(fqdn, dns.TypeSRV)
 
-	r, _, err := s.client.Exchange(m, s.dnsServer)
+	r, err := exchange(m)
 	if err != nil {
 		log.WithField("serviceName", fqdn).
-			WithField("dnsServer", s.dnsServer).
 			WithField("error", err).
 			Error("Error during connection to DNS server")
-		return "", "", err
+		return nil, nil, err
 	}
 
 	if r.Rcode != dns.RcodeSuccess {
+		lookupErr := fmt.Errorf("Service lookup: DNS query did not succeed")
 		log.WithField("serviceName", fqdn).Error("Service lookup: DNS query did not succeed")
-		return "", "", fmt.Errorf("Service lookup: DNS query did not succeed")
+		s.srvCache.set(fqdn, nil, lookupErr, s.negativeTTL(r))
+		return nil, nil, lookupErr
 	}
 
+	var records []*dns.SRV
+	var minTTL uint32
+	seenTTL := false
 	for _, a := range r.Answer {
 		if srv, ok := a.(*dns.SRV); ok {
-			target := srv.Target[:len(srv.Target) - 1]
-			targetIp, err := s.resolveTarget(target)
-			if err == nil {
-				return targetIp.String(), fmt.Sprintf("%d", srv.Port), nil
+			records = append(records, srv)
+			if !seenTTL || srv.Hdr.Ttl < minTTL {
+				minTTL = srv.Hdr.Ttl
+				seenTTL = true
 			}
 		}
 	}
 
-	log.WithField("serviceName", fqdn).Error("Service lookup: No SRV entry in DNS response")
-	return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
+	if len(records) == 0 {
+		lookupErr := fmt.Errorf("Service lookup: No SRV entry in DNS response")
+		s.srvCache.set(fqdn, nil, lookupErr, s.negativeTTL(r))
+		return nil, nil, lookupErr
+	}
+
+	nodeMeta := parseNodeMeta(r)
+
+	s.srvCache.set(fqdn, srvAnswer{records: records, meta: nodeMeta}, nil, time.Duration(minTTL) * time.Second)
+
+	return groupSRVByPriority(records), nodeMeta, nil
+}
+
+// parseNodeMeta extracts Consul node-metadata TXT records from r's
+// Additional section, keyed by the owner name they were returned under (a
+// SRV target's Target) so callers can look up the metadata for a given
+// instance. Each TXT string is a "key=value" pair, per Consul's DNS
+// interface.
+func parseNodeMeta(r *dns.Msg) map[string]map[string]string {
+
+	var meta map[string]map[string]string
+	for _, rr := range r.Extra {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		for _, s := range txt.Txt {
+			parts := strings.SplitN(s, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if meta == nil {
+				meta = make(map[string]map[string]string)
+			}
+			if meta[txt.Hdr.Name] == nil {
+				meta[txt.Hdr.Name] = make(map[string]string)
+			}
+			meta[txt.Hdr.Name][parts[0]] = parts[1]
+		}
+	}
+
+	return meta
+}
+
+// groupSRVByPriority groups SRV records by priority, lowest first, as
+// required by RFC 2782 section 4.
+func groupSRVByPriority(records []*dns.SRV) [][]*dns.SRV {
+
+	byPriority := make(map[uint16][]*dns.SRV)
+	var priorities []uint16
+	for _, srv := range records {
+		if _, seen := byPriority[srv.Priority]; !seen {
+			priorities = append(priorities, srv.Priority)
+		}
+		byPriority[srv.Priority] = append(byPriority[srv.Priority], srv)
+	}
+
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+
+	groups := make([][]*dns.SRV, 0, len(priorities))
+	for _, p := range priorities {
+		groups = append(groups, byPriority[p])
+	}
+
+	return groups
 }
 
-func (s *consulServiceDiscovery) resolveTarget(target string) (ip net.IP, err error) {
+// weightedSRVOrder implements the weighted random selection from RFC 2782:
+// records with weight 0 are returned first, then the remaining records are
+// drawn without replacement where each record's chance of being picked next
+// is Weight / sum(remaining weights), by rolling a uniform random number in
+// [0, total) and walking a running sum.
+func weightedSRVOrder(group []*dns.SRV) []*dns.SRV {
+
+	var zero, weighted []*dns.SRV
+	for _, srv := range group {
+		if srv.Weight == 0 {
+			zero = append(zero, srv)
+		} else {
+			weighted = append(weighted, srv)
+		}
+	}
+
+	ordered := make([]*dns.SRV, 0, len(group))
+	ordered = append(ordered, zero...)
+
+	remaining := append([]*dns.SRV{}, weighted...)
+	for len(remaining) > 0 {
+		total := 0
+		for _, srv := range remaining {
+			total += int(srv.Weight)
+		}
 
-	if val, ok := s.targetCache[target]; ok {
-		return val, nil
+		pick := rand.Intn(total)
+		running := 0
+		for i, srv := range remaining {
+			running += int(srv.Weight)
+			if pick < running {
+				ordered = append(ordered, srv)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
 	}
 
+	return ordered
+}
+
+// addressAnswer is the result of querying a single address family for a
+// target.
+type addressAnswer struct {
+	ip  net.IP
+	ttl time.Duration
+	msg *dns.Msg
+	err error
+}
+
+func (s *serviceDiscovery) resolveTarget(servers []string, target string) (ip net.IP, err error) {
+	return s.resolveTargetWith(target, func(m *dns.Msg) (*dns.Msg, error) {
+		return s.exchangeWithFailover(servers, func(server string) (*dns.Msg, error) {
+			r, _, err := s.client.Exchange(m, server)
+			return r, err
+		})
+	})
+}
+
+// resolveTargetContext is the context.Context-aware counterpart of
+// resolveTarget: it adds an EDNS0 OPT record to the outbound query and
+// automatically retries over TCP if the UDP response comes back truncated.
+func (s *serviceDiscovery) resolveTargetContext(ctx context.Context, servers []string, target string) (ip net.IP, err error) {
+	return s.resolveTargetWith(target, func(m *dns.Msg) (*dns.Msg, error) {
+		return s.exchangeWithFailover(servers, func(server string) (*dns.Msg, error) {
+			return s.exchangeContext(ctx, m, server)
+		})
+	})
+}
+
+// resolveTargetWith resolves target's A and AAAA records in parallel.
+// AAAA is preferred when s.preferIPv6 is set or when only AAAA answers
+// exist; otherwise A wins.
+func (s *serviceDiscovery) resolveTargetWith(target string, exchange func(*dns.Msg) (*dns.Msg, error)) (ip net.IP, err error) {
+
 	fqdn := dns.Fqdn(target)
 
-	m := new(dns.Msg)
-	m.SetQuestion(fqdn, dns.TypeA)
+	if cached, cachedErr, ok := s.targetCache.get(fqdn); ok {
+		if cachedErr != nil {
+			return nil, cachedErr
+		}
+		return cached.(net.IP), nil
+	}
 
-	r, _, err := s.client.Exchange(m, s.dnsServer)
-	if err != nil {
-		log.WithField("fqdn", fqdn).
-		WithField("target", target).
-		WithField("dnsServer", s.dnsServer).
-		WithField("error", err).
-		Error("Error during connection to DNS server")
-		return nil, err
+	answers := make(chan struct {
+		qtype uint16
+		addressAnswer
+	}, 2)
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		qtype := qtype
+		go func() {
+			m := new(dns.Msg)
+			m.SetQuestion(fqdn, qtype)
+
+			r, err := exchange(m)
+			if err != nil {
+				answers <- struct {
+					qtype uint16
+					addressAnswer
+				}{qtype, addressAnswer{err: err}}
+				return
+			}
+
+			answers <- struct {
+				qtype uint16
+				addressAnswer
+			}{qtype, extractAddress(r, qtype)}
+		}()
+	}
+
+	var a, aaaa addressAnswer
+	for i := 0; i < 2; i++ {
+		res := <-answers
+		if res.qtype == dns.TypeA {
+			a = res.addressAnswer
+		} else {
+			aaaa = res.addressAnswer
+		}
+	}
+
+	if aaaa.ip != nil && (s.preferIPv6 || a.ip == nil) {
+		s.targetCache.set(fqdn, aaaa.ip, nil, aaaa.ttl)
+		return aaaa.ip, nil
+	}
+
+	if a.ip != nil {
+		s.targetCache.set(fqdn, a.ip, nil, a.ttl)
+		return a.ip, nil
+	}
+
+	lookupErr := a.err
+	if lookupErr == nil {
+		lookupErr = aaaa.err
+	}
+	if lookupErr == nil {
+		lookupErr = fmt.Errorf("Service lookup: No A entry in DNS response")
+	}
+	log.WithField("target", target).WithField("error", lookupErr).Error("Service lookup: Target DNS query did not succeed")
+
+	negativeFrom := a.msg
+	if negativeFrom == nil {
+		negativeFrom = aaaa.msg
+	}
+	if negativeFrom != nil {
+		s.targetCache.set(fqdn, nil, lookupErr, s.negativeTTL(negativeFrom))
 	}
 
+	return nil, lookupErr
+}
+
+// extractAddress pulls the first A or AAAA record (matching qtype) out of
+// r's answer section.
+func extractAddress(r *dns.Msg, qtype uint16) addressAnswer {
+
 	if r.Rcode != dns.RcodeSuccess {
-		log.WithField("fqdn", fqdn).WithField("target", target).Error("Service lookup: Target DNS query did not succeed")
-		return nil, fmt.Errorf("Service lookup: Target DNS query did not succeed")
+		return addressAnswer{msg: r, err: fmt.Errorf("Service lookup: Target DNS query did not succeed")}
 	}
 
-	for _, a := range r.Answer {
-		if srv, ok := a.(*dns.A); ok {
-			s.targetCache[target] = srv.A
-			return srv.A, nil
+	for _, rr := range r.Answer {
+		switch qtype {
+		case dns.TypeA:
+			if a, ok := rr.(*dns.A); ok {
+				return addressAnswer{ip: a.A, ttl: time.Duration(a.Hdr.Ttl) * time.Second, msg: r}
+			}
+		case dns.TypeAAAA:
+			if aaaa, ok := rr.(*dns.AAAA); ok {
+				return addressAnswer{ip: aaaa.AAAA, ttl: time.Duration(aaaa.Hdr.Ttl) * time.Second, msg: r}
+			}
 		}
 	}
 
-	log.WithField("fqdn", fqdn).WithField("target", target).Error("Service lookup: No A entry in DNS response")
-	return nil, fmt.Errorf("Service lookup: No A entry in DNS response")
+	return addressAnswer{msg: r, err: fmt.Errorf("Service lookup: No A entry in DNS response")}
+}
+
+// negativeTTL derives how long an NXDOMAIN or empty answer should be
+// cached: the minimum TTL advertised by the zone's SOA record (RFC 2308),
+// capped by s.maxNegativeTTL so a misconfigured zone can't extend it
+// indefinitely.
+func (s *serviceDiscovery) negativeTTL(r *dns.Msg) time.Duration {
+
+	ttl := s.maxNegativeTTL
+
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if soaTTL := time.Duration(soa.Minttl) * time.Second; soaTTL < ttl {
+				ttl = soaTTL
+			}
+			break
+		}
+	}
 
-}
\ No newline at end of file
+	return ttl
+}
+
+// rotatedServers returns s.servers starting from an atomically advancing
+// offset, so successive calls spread load across all configured servers
+// instead of always hammering the first one.
+func (s *serviceDiscovery) rotatedServers() []string {
+
+	if len(s.servers) <= 1 {
+		return s.servers
+	}
+
+	start := int(atomic.AddUint32(&s.nextServer, 1)-1) % len(s.servers)
+
+	rotated := make([]string, 0, len(s.servers))
+	rotated = append(rotated, s.servers[start:]...)
+	rotated = append(rotated, s.servers[:start]...)
+	return rotated
+}
+
+// exchangeWithFailover tries every server in servers, in order, moving on
+// to the next one when a server is unreachable or returns SERVFAIL.
+func (s *serviceDiscovery) exchangeWithFailover(servers []string, exchange func(server string) (*dns.Msg, error)) (*dns.Msg, error) {
+
+	var lastErr error
+	for _, server := range servers {
+		r, err := exchange(server)
+		if err != nil {
+			log.WithField("dnsServer", server).WithField("error", err).Error("Error during connection to DNS server")
+			lastErr = err
+			continue
+		}
+		if r.Rcode == dns.RcodeServerFailure {
+			log.WithField("dnsServer", server).Error("DNS server returned SERVFAIL")
+			lastErr = fmt.Errorf("DNS server %s returned SERVFAIL", server)
+			continue
+		}
+		return r, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("No DNS servers configured")
+	}
+	return nil, lastErr
+}
+
+// exchangeContext sends m to server with an EDNS0 OPT record advertising a
+// 4096-byte UDP buffer (mirroring how stub resolvers avoid 512-byte
+// truncation), and automatically retries over TCP if the response
+// nonetheless comes back truncated.
+func (s *serviceDiscovery) exchangeContext(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+
+	m.SetEdns0(edns0BufferSize, false)
+
+	r, _, err := s.client.ExchangeContext(ctx, m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Truncated && s.tcpClient != nil {
+		r, _, err = s.tcpClient.ExchangeContext(ctx, m, server)
+	}
+
+	return r, err
+}
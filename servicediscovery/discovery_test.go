@@ -1,6 +1,7 @@
 package servicediscovery
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -11,6 +12,36 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// qtypeMatcher matches an outbound *dns.Msg by its question's query type,
+// so tests can give the A and AAAA lookups that resolveTarget fires in
+// parallel distinct, deterministic responses.
+type qtypeMatcher struct {
+	qtype uint16
+}
+
+func forQtype(qtype uint16) gomock.Matcher {
+	return qtypeMatcher{qtype: qtype}
+}
+
+func (m qtypeMatcher) Matches(x interface{}) bool {
+	msg, ok := x.(*dns.Msg)
+	return ok && len(msg.Question) == 1 && msg.Question[0].Qtype == m.qtype
+}
+
+func (m qtypeMatcher) String() string {
+	return fmt.Sprintf("is a query for qtype %d", m.qtype)
+}
+
+func noAAAARecords(mockDnsClient *MockDnsClient, server string, after *gomock.Call) {
+	call := mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeAAAA), server).Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{}},
+		time.Duration(0), nil)
+	if after != nil {
+		call.After(after)
+	}
+}
+
 func TestServiceDiscovery_DiscoverService_NoEntries(t *testing.T) {
 	a := assert.New(t)
 	ctrl := gomock.NewController(t)
@@ -21,9 +52,12 @@ func TestServiceDiscovery_DiscoverService_NoEntries(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: 0}}, time.Duration(0), nil)
@@ -47,9 +81,12 @@ func TestServiceDiscovery_DiscoverService(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
@@ -64,15 +101,14 @@ func TestServiceDiscovery_DiscoverService(t *testing.T) {
 		}},
 		time.Duration(0), nil)
 
-	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
 		MsgHdr: dns.MsgHdr{Rcode: 0},
 		Answer: []dns.RR{
 			&dns.A{
 				A: net.IPv4(10, 0, 0, 1)},
-			&dns.A{
-				A: net.IPv4(10, 0, 0, 2)},
 		}},
-		time.Duration(0), nil).After(srvCall).Times(2)
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
 
 	// when
 	ip, port, err := testSubject.DiscoverService("serviceName")
@@ -93,9 +129,12 @@ func TestServiceDiscovery_SRV_NoSuccess(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
@@ -122,9 +161,12 @@ func TestServiceDiscovery_Exchange_SRV_Fail(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(nil, time.Duration(0), fmt.Errorf("error"))
@@ -148,9 +190,12 @@ func TestServiceDiscovery_Resolve_A_Fail(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
@@ -165,7 +210,8 @@ func TestServiceDiscovery_Resolve_A_Fail(t *testing.T) {
 		}},
 		time.Duration(0), nil)
 
-	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(nil, time.Duration(0), fmt.Errorf("error")).Times(2)
+	// each of the two targets issues one A and one AAAA query, both of which fail
+	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(nil, time.Duration(0), fmt.Errorf("error")).Times(4)
 
 	// when
 	ip, port, err := testSubject.DiscoverService("serviceName")
@@ -186,9 +232,12 @@ func TestServiceDiscovery_A_NoSuccess(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
@@ -206,7 +255,7 @@ func TestServiceDiscovery_A_NoSuccess(t *testing.T) {
 	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
 		MsgHdr: dns.MsgHdr{Rcode: 1},
 		Answer: []dns.RR{}},
-		time.Duration(0), nil).After(srvCall).Times(2)
+		time.Duration(0), nil).After(srvCall).Times(4)
 
 	// when
 	ip, port, err := testSubject.DiscoverService("serviceName")
@@ -227,9 +276,12 @@ func TestServiceDiscovery_NoARecords(t *testing.T) {
 
 	// given: test subject
 	testSubject := serviceDiscovery{
-		dnsServer: "dnsServer",
-		dnsSearch: "dnsSearch",
-		client:    mockDnsClient}
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
 
 	// expect
 	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
@@ -247,7 +299,7 @@ func TestServiceDiscovery_NoARecords(t *testing.T) {
 	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
 		MsgHdr: dns.MsgHdr{Rcode: 0},
 		Answer: []dns.RR{}},
-		time.Duration(0), nil).After(srvCall).Times(2)
+		time.Duration(0), nil).After(srvCall).Times(4)
 
 	// when
 	ip, port, err := testSubject.DiscoverService("serviceName")
@@ -264,13 +316,13 @@ func TestConsulServiceDiscovery_Constructor_IP(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, _ := NewConsulServiceDiscovery("127.0.0.1:53")
+	testSubject, _ := NewConsulServiceDiscovery([]string{"127.0.0.1:53"})
 	castedTestSubject := testSubject.(*serviceDiscovery)
 
 	// then
-	a.Equal(castedTestSubject.dnsServer, "127.0.0.1:53")
-	a.Equal(castedTestSubject.dnsSearch, ".service.consul")
-	a.Equal(castedTestSubject.client, &dns.Client{})
+	a.Equal([]string{"127.0.0.1:53"}, castedTestSubject.servers)
+	a.Equal(".service.consul", castedTestSubject.dnsSearch)
+	a.Equal(&dns.Client{}, castedTestSubject.client)
 }
 
 func TestServiceDiscovery_Constructor_IP(t *testing.T) {
@@ -279,13 +331,13 @@ func TestServiceDiscovery_Constructor_IP(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, _ := NewServiceDiscovery("127.0.0.1:53", "dnsSearch")
+	testSubject, _ := NewServiceDiscovery([]string{"127.0.0.1:53"}, "dnsSearch")
 	castedTestSubject := testSubject.(*serviceDiscovery)
 
 	// then
-	a.Equal(castedTestSubject.dnsServer, "127.0.0.1:53")
-	a.Equal(castedTestSubject.dnsSearch, "dnsSearch")
-	a.Equal(castedTestSubject.client, &dns.Client{})
+	a.Equal([]string{"127.0.0.1:53"}, castedTestSubject.servers)
+	a.Equal("dnsSearch", castedTestSubject.dnsSearch)
+	a.Equal(&dns.Client{}, castedTestSubject.client)
 }
 
 func TestConsulServiceDiscovery_Constructor_Hostname(t *testing.T) {
@@ -294,13 +346,13 @@ func TestConsulServiceDiscovery_Constructor_Hostname(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, _ := NewConsulServiceDiscovery("localhost:53")
+	testSubject, _ := NewConsulServiceDiscovery([]string{"localhost:53"})
 	castedTestSubject := testSubject.(*serviceDiscovery)
 
 	// then
-	a.Equal(castedTestSubject.dnsServer, "[::1]:53")
-	a.Equal(castedTestSubject.dnsSearch, ".service.consul")
-	a.Equal(castedTestSubject.client, &dns.Client{})
+	a.Equal([]string{"[::1]:53"}, castedTestSubject.servers)
+	a.Equal(".service.consul", castedTestSubject.dnsSearch)
+	a.Equal(&dns.Client{}, castedTestSubject.client)
 }
 
 func TestServiceDiscovery_Constructor_Hostname(t *testing.T) {
@@ -309,13 +361,13 @@ func TestServiceDiscovery_Constructor_Hostname(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, _ := NewServiceDiscovery("localhost:53", "dnsSearch")
+	testSubject, _ := NewServiceDiscovery([]string{"localhost:53"}, "dnsSearch")
 	castedTestSubject := testSubject.(*serviceDiscovery)
 
 	// then
-	a.Equal(castedTestSubject.dnsServer, "[::1]:53")
-	a.Equal(castedTestSubject.dnsSearch, "dnsSearch")
-	a.Equal(castedTestSubject.client, &dns.Client{})
+	a.Equal([]string{"[::1]:53"}, castedTestSubject.servers)
+	a.Equal("dnsSearch", castedTestSubject.dnsSearch)
+	a.Equal(&dns.Client{}, castedTestSubject.client)
 }
 
 func TestConsulServiceDiscovery_Constructor_WrongArg(t *testing.T) {
@@ -324,7 +376,7 @@ func TestConsulServiceDiscovery_Constructor_WrongArg(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, err := NewConsulServiceDiscovery("localhost::53")
+	testSubject, err := NewConsulServiceDiscovery([]string{"localhost::53"})
 
 	// then
 	a.Nil(testSubject)
@@ -337,7 +389,7 @@ func TestServiceDiscovery_Constructor_WrongArg(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, err := NewServiceDiscovery("localhost::53", "dnsSearch")
+	testSubject, err := NewServiceDiscovery([]string{"localhost::53"}, "dnsSearch")
 
 	// then
 	a.Nil(testSubject)
@@ -350,7 +402,7 @@ func TestConsulServiceDiscovery_Constructor_UnknownHost(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, err := NewConsulServiceDiscovery("unknown:53")
+	testSubject, err := NewConsulServiceDiscovery([]string{"unknown:53"})
 
 	// then
 	a.Nil(testSubject)
@@ -363,9 +415,507 @@ func TestServiceDiscovery_Constructor_UnknownHost(t *testing.T) {
 	defer ctrl.Finish()
 
 	// when
-	testSubject, err := NewServiceDiscovery("unknown:53", "dnsSearch")
+	testSubject, err := NewServiceDiscovery([]string{"unknown:53"}, "dnsSearch")
 
 	// then
 	a.Nil(testSubject)
 	a.EqualError(err, "lookup unknown: no such host")
 }
+
+func TestConsulServiceDiscovery_Constructor_NoServers(t *testing.T) {
+	a := assert.New(t)
+
+	// when
+	testSubject, err := NewConsulServiceDiscovery(nil)
+
+	// then
+	a.Nil(testSubject)
+	a.EqualError(err, "No service discovery host given")
+}
+
+func TestServiceDiscovery_DiscoverService_PicksLowestPriority(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: the priority-10 target is unreachable, so the priority-20 one must be used instead
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{
+				Target:   "unreachable.",
+				Port:     1,
+				Priority: 10,
+				Weight:   1},
+			&dns.SRV{
+				Target:   "hostname2.",
+				Port:     2,
+				Priority: 20,
+				Weight:   1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(nil, time.Duration(0), fmt.Errorf("error")).After(srvCall).Times(2)
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 2)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then the lower-priority group's target is returned
+	a.Equal("10.0.0.2", ip)
+	a.Equal("2", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_DiscoverAllServiceInstances_PreservesPriorityAndWeight(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{
+				Target:   "hostname1.",
+				Port:     1,
+				Priority: 10,
+				Weight:   5},
+			&dns.SRV{
+				Target:   "hostname2.",
+				Port:     2,
+				Priority: 20,
+				Weight:   0},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 2)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer", srvCall)
+
+	// when
+	instances, err := testSubject.DiscoverAllServiceInstances("serviceName")
+
+	// then instances come back ordered by ascending priority with their weight preserved
+	a.NoError(err)
+	a.Len(instances, 2)
+	a.Equal(ServiceInstance{Host: "hostname1", IP: net.IPv4(10, 0, 0, 1), Port: 1, Priority: 10, Weight: 5}, instances[0])
+	a.Equal(ServiceInstance{Host: "hostname2", IP: net.IPv4(10, 0, 0, 2), Port: 2, Priority: 20, Weight: 0}, instances[1])
+}
+
+func TestServiceDiscovery_DiscoverService_FailsOverToNextServer(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject with two servers, the first of which is down
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer1", "dnsServer2"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer2").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{
+				Target: "hostname1.",
+				Port:   1},
+		}},
+		time.Duration(0), nil)
+
+	// dnsServer1 is tried first for the SRV lookup and for each of the
+	// parallel A/AAAA lookups that follow it, since the rotated server
+	// order is computed once per Discover call and reused throughout
+	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer1").Return(nil, time.Duration(0), fmt.Errorf("connection refused")).Times(3)
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer2").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	noAAAARecords(mockDnsClient, "dnsServer2", srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then the second server's answer is used
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_ResolveTarget_PrefersAAAAWhenOnlyFamilyAvailable(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: no A record at all, only AAAA
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{}},
+		time.Duration(0), nil).After(srvCall)
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeAAAA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.AAAA{AAAA: net.ParseIP("fe80::1")},
+		}},
+		time.Duration(0), nil).After(srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then the AAAA address is used, even without PreferIPv6
+	a.Equal("fe80::1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_ResolveTarget_PreferIPv6(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject with PreferIPv6 set, and both families on offer
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL,
+		preferIPv6:     true}
+
+	// expect
+	srvCall := mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	mockDnsClient.EXPECT().Exchange(forQtype(dns.TypeAAAA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.AAAA{AAAA: net.ParseIP("fe80::1")},
+		}},
+		time.Duration(0), nil).After(srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then the AAAA address wins over the A address
+	a.Equal("fe80::1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_DiscoverServiceContext(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect
+	srvCall := mockDnsClient.EXPECT().ExchangeContext(gomock.Any(), gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().ExchangeContext(gomock.Any(), forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil).After(srvCall)
+	mockDnsClient.EXPECT().ExchangeContext(gomock.Any(), forQtype(dns.TypeAAAA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{}},
+		time.Duration(0), nil).After(srvCall)
+
+	// when
+	ip, port, err := testSubject.DiscoverServiceContext(context.Background(), "serviceName")
+
+	// then the correct ip and port is returned
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_ExchangeContext_RetriesOverTCPOnTruncation(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+	mockTcpClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		tcpClient:      mockTcpClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: the UDP response is truncated, so the TCP client is used instead
+	mockDnsClient.EXPECT().ExchangeContext(gomock.Any(), gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0, Truncated: true}},
+		time.Duration(0), nil)
+
+	mockTcpClient.EXPECT().ExchangeContext(gomock.Any(), gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil)
+
+	mockDnsClient.EXPECT().ExchangeContext(gomock.Any(), forQtype(dns.TypeA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.A{A: net.IPv4(10, 0, 0, 1)},
+		}},
+		time.Duration(0), nil)
+	mockDnsClient.EXPECT().ExchangeContext(gomock.Any(), forQtype(dns.TypeAAAA), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{}},
+		time.Duration(0), nil)
+
+	// when
+	ip, port, err := testSubject.DiscoverServiceContext(context.Background(), "serviceName")
+
+	// then the SRV lookup still succeeds, via the TCP retry
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestServiceDiscovery_SRVCache_HitAvoidsSecondQuery(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: only one SRV query is ever issued, with a TTL long enough
+	// that the second lookup must be served from srvCache
+	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{
+			&dns.SRV{Hdr: dns.RR_Header{Ttl: 60}, Target: "hostname1.", Port: 1},
+		}},
+		time.Duration(0), nil).Times(1)
+
+	// when
+	_, groups1, _, err1 := testSubject.lookupSRVByPriority([]string{"dnsServer"}, "serviceName")
+	_, groups2, _, err2 := testSubject.lookupSRVByPriority([]string{"dnsServer"}, "serviceName")
+
+	// then both lookups succeed with the same, cached answer
+	a.NoError(err1)
+	a.NoError(err2)
+	a.Equal(groups1, groups2)
+}
+
+func TestServiceDiscovery_SRVCache_NegativeCachingAvoidsSecondQuery(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: only one query is ever issued; the empty answer's SOA
+	// minimum TTL (RFC 2308) is long enough that the second lookup must be
+	// served from the negative cache
+	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{},
+		Ns: []dns.RR{
+			&dns.SOA{Hdr: dns.RR_Header{Ttl: 60}, Minttl: 60},
+		}},
+		time.Duration(0), nil).Times(1)
+
+	// when
+	_, _, _, err1 := testSubject.lookupSRVByPriority([]string{"dnsServer"}, "serviceName")
+	_, _, _, err2 := testSubject.lookupSRVByPriority([]string{"dnsServer"}, "serviceName")
+
+	// then both lookups return the same cached failure
+	a.EqualError(err1, "Service lookup: No SRV entry in DNS response")
+	a.EqualError(err2, "Service lookup: No SRV entry in DNS response")
+}
+
+func TestServiceDiscovery_SRVCache_ZeroSOAMinttlIsNotCached(t *testing.T) {
+	a := assert.New(t)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// given: mocks
+	mockDnsClient := NewMockDnsClient(ctrl)
+
+	// given: test subject
+	testSubject := serviceDiscovery{
+		servers:        []string{"dnsServer"},
+		dnsSearch:      "dnsSearch",
+		client:         mockDnsClient,
+		targetCache:    newTTLCache(),
+		srvCache:       newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+
+	// expect: a SOA minttl of 0 resolves to a 0 negative TTL, which
+	// ttlCache never stores, so every lookup re-queries
+	mockDnsClient.EXPECT().Exchange(gomock.Any(), "dnsServer").Return(&dns.Msg{
+		MsgHdr: dns.MsgHdr{Rcode: 0},
+		Answer: []dns.RR{},
+		Ns: []dns.RR{
+			&dns.SOA{Minttl: 0},
+		}},
+		time.Duration(0), nil).Times(2)
+
+	// when
+	_, _, _, err1 := testSubject.lookupSRVByPriority([]string{"dnsServer"}, "serviceName")
+	_, _, _, err2 := testSubject.lookupSRVByPriority([]string{"dnsServer"}, "serviceName")
+
+	// then both lookups re-queried since nothing was cached
+	a.EqualError(err1, "Service lookup: No SRV entry in DNS response")
+	a.EqualError(err2, "Service lookup: No SRV entry in DNS response")
+}
+
+func TestServiceDiscovery_NegativeTTL_UsesSOAMinimumWhenLowerThanMax(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := serviceDiscovery{maxNegativeTTL: 60 * time.Second}
+
+	r := &dns.Msg{Ns: []dns.RR{&dns.SOA{Minttl: 5}}}
+
+	a.Equal(5*time.Second, testSubject.negativeTTL(r))
+}
+
+func TestServiceDiscovery_NegativeTTL_CappedByMaxNegativeTTL(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := serviceDiscovery{maxNegativeTTL: 10 * time.Second}
+
+	r := &dns.Msg{Ns: []dns.RR{&dns.SOA{Minttl: 3600}}}
+
+	a.Equal(10*time.Second, testSubject.negativeTTL(r))
+}
+
+func TestServiceDiscovery_Constructor_WithMaxNegativeTTL(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject, _ := NewServiceDiscovery([]string{"127.0.0.1:53"}, "dnsSearch", WithMaxNegativeTTL(5*time.Second))
+	castedTestSubject := testSubject.(*serviceDiscovery)
+
+	a.Equal(5*time.Second, castedTestSubject.maxNegativeTTL)
+}
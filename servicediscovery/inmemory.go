@@ -0,0 +1,248 @@
+package servicediscovery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMemoryServiceDiscovery is a ServiceDiscovery backed entirely by the
+// fixtures a test populates, so consumers of this package can exercise
+// their code against a fixed zone instead of standing up a DNS server or
+// mocking DnsClient themselves. SRV selection follows the same RFC 2782
+// priority/weight rules as serviceDiscovery, and resolved target addresses
+// are cached for TTL, with Clock standing in for time.Now so tests can
+// advance it deterministically to exercise cache expiry.
+type InMemoryServiceDiscovery struct {
+	// SRV, A and AAAA describe the fixed zone, keyed by service name and
+	// target hostname respectively.
+	SRV  map[string][]ServiceInstance
+	A    map[string][]net.IP
+	AAAA map[string][]net.IP
+
+	// Fail holds synthetic failures for a given query, keyed "srv
+	// <service>", "a <host>" or "aaaa <host>".
+	Fail map[string]error
+
+	// TTL is how long a resolved target address is cached; zero disables
+	// caching.
+	TTL time.Duration
+
+	// Clock supplies the current time for cache expiry. Defaults to
+	// time.Now.
+	Clock func() time.Time
+
+	mu          sync.Mutex
+	targetCache map[string]inMemoryCacheEntry
+}
+
+type inMemoryCacheEntry struct {
+	ip        net.IP
+	expiresAt time.Time
+}
+
+var _ ServiceDiscovery = (*InMemoryServiceDiscovery)(nil)
+
+// NewInMemoryServiceDiscovery builds an empty InMemoryServiceDiscovery.
+// Populate SRV, A, AAAA and Fail directly before use.
+func NewInMemoryServiceDiscovery() *InMemoryServiceDiscovery {
+	return &InMemoryServiceDiscovery{
+		SRV:         make(map[string][]ServiceInstance),
+		A:           make(map[string][]net.IP),
+		AAAA:        make(map[string][]net.IP),
+		Fail:        make(map[string]error),
+		Clock:       time.Now,
+		targetCache: make(map[string]inMemoryCacheEntry),
+	}
+}
+
+func (d *InMemoryServiceDiscovery) DiscoverService(serviceName string) (ip string, port string, err error) {
+
+	groups, err := d.lookupSRV(serviceName)
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, group := range groups {
+		for _, inst := range weightedInstanceOrder(group) {
+			targetIP, err := d.resolveTarget(inst.Host)
+			if err == nil {
+				return targetIP.String(), fmt.Sprintf("%d", inst.Port), nil
+			}
+		}
+	}
+
+	return "", "", fmt.Errorf("Service lookup: No SRV entry in DNS response")
+}
+
+func (d *InMemoryServiceDiscovery) DiscoverAllServiceInstances(serviceName string) (instances []ServiceInstance, err error) {
+
+	groups, err := d.lookupSRV(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		for _, inst := range weightedInstanceOrder(group) {
+			targetIP, err := d.resolveTarget(inst.Host)
+			if err != nil {
+				continue
+			}
+			instances = append(instances, ServiceInstance{
+				Host:     inst.Host,
+				IP:       targetIP,
+				Port:     inst.Port,
+				Priority: inst.Priority,
+				Weight:   inst.Weight})
+		}
+	}
+
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("Service lookup: No SRV entry in DNS response")
+	}
+
+	return instances, nil
+}
+
+// DiscoverServiceContext and DiscoverAllServiceInstancesContext ignore ctx:
+// there is nothing in an in-memory lookup that ever blocks.
+func (d *InMemoryServiceDiscovery) DiscoverServiceContext(ctx context.Context, serviceName string) (ip string, port string, err error) {
+	return d.DiscoverService(serviceName)
+}
+
+func (d *InMemoryServiceDiscovery) DiscoverAllServiceInstancesContext(ctx context.Context, serviceName string) (instances []ServiceInstance, err error) {
+	return d.DiscoverAllServiceInstances(serviceName)
+}
+
+func (d *InMemoryServiceDiscovery) lookupSRV(serviceName string) ([][]ServiceInstance, error) {
+
+	if err, ok := d.Fail["srv "+serviceName]; ok {
+		return nil, err
+	}
+
+	instances, ok := d.SRV[serviceName]
+	if !ok || len(instances) == 0 {
+		return nil, fmt.Errorf("Service lookup: No SRV entry in DNS response")
+	}
+
+	return groupInstancesByPriority(instances), nil
+}
+
+// resolveTarget resolves host's address the same way serviceDiscovery does:
+// A before AAAA, cached for TTL.
+func (d *InMemoryServiceDiscovery) resolveTarget(host string) (net.IP, error) {
+
+	d.mu.Lock()
+	if entry, ok := d.targetCache[host]; ok && d.now().Before(entry.expiresAt) {
+		d.mu.Unlock()
+		return entry.ip, nil
+	}
+	d.mu.Unlock()
+
+	ip, err := d.lookupAddress(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.TTL > 0 {
+		d.mu.Lock()
+		d.targetCache[host] = inMemoryCacheEntry{ip: ip, expiresAt: d.now().Add(d.TTL)}
+		d.mu.Unlock()
+	}
+
+	return ip, nil
+}
+
+func (d *InMemoryServiceDiscovery) lookupAddress(host string) (net.IP, error) {
+
+	aErr, aFailed := d.Fail["a "+host]
+	if !aFailed {
+		if ips := d.A[host]; len(ips) > 0 {
+			return ips[0], nil
+		}
+		aErr = fmt.Errorf("Service lookup: No A entry in DNS response")
+	}
+
+	if _, aaaaFailed := d.Fail["aaaa "+host]; !aaaaFailed {
+		if ips := d.AAAA[host]; len(ips) > 0 {
+			return ips[0], nil
+		}
+	}
+
+	return nil, aErr
+}
+
+func (d *InMemoryServiceDiscovery) now() time.Time {
+	if d.Clock != nil {
+		return d.Clock()
+	}
+	return time.Now()
+}
+
+// groupInstancesByPriority groups instances by priority, lowest first, as
+// required by RFC 2782 section 4. This mirrors groupSRVByPriority, but
+// operates on ServiceInstance rather than *dns.SRV since InMemoryServiceDiscovery
+// fixtures are declared directly as ServiceInstance values.
+func groupInstancesByPriority(instances []ServiceInstance) [][]ServiceInstance {
+
+	byPriority := make(map[uint16][]ServiceInstance)
+	var priorities []uint16
+	for _, inst := range instances {
+		if _, seen := byPriority[inst.Priority]; !seen {
+			priorities = append(priorities, inst.Priority)
+		}
+		byPriority[inst.Priority] = append(byPriority[inst.Priority], inst)
+	}
+
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+
+	groups := make([][]ServiceInstance, 0, len(priorities))
+	for _, p := range priorities {
+		groups = append(groups, byPriority[p])
+	}
+
+	return groups
+}
+
+// weightedInstanceOrder is the ServiceInstance counterpart of
+// weightedSRVOrder: zero-weight instances first, then the rest drawn
+// without replacement with probability Weight / sum(remaining weights).
+func weightedInstanceOrder(group []ServiceInstance) []ServiceInstance {
+
+	var zero, weighted []ServiceInstance
+	for _, inst := range group {
+		if inst.Weight == 0 {
+			zero = append(zero, inst)
+		} else {
+			weighted = append(weighted, inst)
+		}
+	}
+
+	ordered := make([]ServiceInstance, 0, len(group))
+	ordered = append(ordered, zero...)
+
+	remaining := append([]ServiceInstance{}, weighted...)
+	for len(remaining) > 0 {
+		total := 0
+		for _, inst := range remaining {
+			total += int(inst.Weight)
+		}
+
+		pick := rand.Intn(total)
+		running := 0
+		for i, inst := range remaining {
+			running += int(inst.Weight)
+			if pick < running {
+				ordered = append(ordered, inst)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
@@ -0,0 +1,158 @@
+package servicediscovery
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryServiceDiscovery_DiscoverService(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject
+	testSubject := NewInMemoryServiceDiscovery()
+	testSubject.SRV["serviceName"] = []ServiceInstance{
+		{Host: "hostname1.", Port: 1},
+	}
+	testSubject.A["hostname1."] = []net.IP{net.IPv4(10, 0, 0, 1)}
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then
+	a.Equal("10.0.0.1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestInMemoryServiceDiscovery_DiscoverService_NoSRVEntry(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject
+	testSubject := NewInMemoryServiceDiscovery()
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then
+	a.Equal("", ip)
+	a.Equal("", port)
+	a.EqualError(err, "Service lookup: No SRV entry in DNS response")
+}
+
+func TestInMemoryServiceDiscovery_DiscoverService_SRVFailure(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject
+	testSubject := NewInMemoryServiceDiscovery()
+	testSubject.Fail["srv serviceName"] = fmt.Errorf("connection refused")
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then
+	a.Equal("", ip)
+	a.Equal("", port)
+	a.EqualError(err, "connection refused")
+}
+
+func TestInMemoryServiceDiscovery_DiscoverService_PicksLowestPriority(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject; the priority-10 target has no A record, so the
+	// priority-20 one must be used instead
+	testSubject := NewInMemoryServiceDiscovery()
+	testSubject.SRV["serviceName"] = []ServiceInstance{
+		{Host: "unreachable.", Port: 1, Priority: 10, Weight: 1},
+		{Host: "hostname2.", Port: 2, Priority: 20, Weight: 1},
+	}
+	testSubject.A["hostname2."] = []net.IP{net.IPv4(10, 0, 0, 2)}
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then
+	a.Equal("10.0.0.2", ip)
+	a.Equal("2", port)
+	a.NoError(err)
+}
+
+func TestInMemoryServiceDiscovery_DiscoverAllServiceInstances_PreservesPriorityAndWeight(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject
+	testSubject := NewInMemoryServiceDiscovery()
+	testSubject.SRV["serviceName"] = []ServiceInstance{
+		{Host: "hostname1.", Port: 1, Priority: 10, Weight: 5},
+		{Host: "hostname2.", Port: 2, Priority: 20, Weight: 0},
+	}
+	testSubject.A["hostname1."] = []net.IP{net.IPv4(10, 0, 0, 1)}
+	testSubject.A["hostname2."] = []net.IP{net.IPv4(10, 0, 0, 2)}
+
+	// when
+	instances, err := testSubject.DiscoverAllServiceInstances("serviceName")
+
+	// then instances come back ordered by ascending priority with their weight preserved
+	a.NoError(err)
+	a.Equal([]ServiceInstance{
+		{Host: "hostname1.", IP: net.IPv4(10, 0, 0, 1), Port: 1, Priority: 10, Weight: 5},
+		{Host: "hostname2.", IP: net.IPv4(10, 0, 0, 2), Port: 2, Priority: 20, Weight: 0},
+	}, instances)
+}
+
+func TestInMemoryServiceDiscovery_DiscoverService_FallsBackToAAAA(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject; no A record at all, only AAAA
+	testSubject := NewInMemoryServiceDiscovery()
+	testSubject.SRV["serviceName"] = []ServiceInstance{
+		{Host: "hostname1.", Port: 1},
+	}
+	testSubject.AAAA["hostname1."] = []net.IP{net.ParseIP("fe80::1")}
+
+	// when
+	ip, port, err := testSubject.DiscoverService("serviceName")
+
+	// then
+	a.Equal("fe80::1", ip)
+	a.Equal("1", port)
+	a.NoError(err)
+}
+
+func TestInMemoryServiceDiscovery_ResolveTarget_CachesUntilTTLExpires(t *testing.T) {
+	a := assert.New(t)
+
+	// given: test subject with a fake clock and a target whose A record
+	// changes after the first lookup
+	now := time.Unix(0, 0)
+	testSubject := NewInMemoryServiceDiscovery()
+	testSubject.TTL = time.Minute
+	testSubject.Clock = func() time.Time { return now }
+	testSubject.SRV["serviceName"] = []ServiceInstance{
+		{Host: "hostname1.", Port: 1},
+	}
+	testSubject.A["hostname1."] = []net.IP{net.IPv4(10, 0, 0, 1)}
+
+	ip, _, err := testSubject.DiscoverService("serviceName")
+	a.Equal("10.0.0.1", ip)
+	a.NoError(err)
+
+	// when: the fixture changes but the TTL has not yet elapsed
+	testSubject.A["hostname1."] = []net.IP{net.IPv4(10, 0, 0, 2)}
+	ip, _, err = testSubject.DiscoverService("serviceName")
+
+	// then the stale, cached address is still returned
+	a.Equal("10.0.0.1", ip)
+	a.NoError(err)
+
+	// when: the clock advances past the TTL
+	now = now.Add(2 * time.Minute)
+	ip, _, err = testSubject.DiscoverService("serviceName")
+
+	// then the new address is resolved
+	a.Equal("10.0.0.2", ip)
+	a.NoError(err)
+}
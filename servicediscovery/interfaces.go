@@ -1,15 +1,47 @@
 package servicediscovery
 
 import (
+	"context"
 	"github.com/miekg/dns"
+	"net"
 	"time"
 )
 
+//go:generate mockgen -source=interfaces.go -destination=mocks.go -package=servicediscovery
+
 type DnsClient interface {
 	Exchange(*dns.Msg, string) (r *dns.Msg, rtt time.Duration, err error)
+	ExchangeContext(ctx context.Context, m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
 }
 
 type ServiceDiscovery interface {
 	DiscoverService(serviceName string) (ip string, port string, err error)
+	DiscoverServiceContext(ctx context.Context, serviceName string) (ip string, port string, err error)
 	DiscoverAllServiceInstances(serviceName string) (instances []ServiceInstance, err error)
+	DiscoverAllServiceInstancesContext(ctx context.Context, serviceName string) (instances []ServiceInstance, err error)
+}
+
+// ConsulServiceDiscovery extends ServiceDiscovery with lookups that are
+// only meaningful against Consul's DNS interface: filtering by tag, and
+// RFC 2782 style service/tag/protocol queries.
+type ConsulServiceDiscovery interface {
+	ServiceDiscovery
+	DiscoverServiceWithTag(service string, tag string) (ip string, port string, err error)
+	DiscoverServiceRFC2782(service string, tag string, proto string) (ip string, port string, err error)
+}
+
+// ServiceInstance describes a single SRV target returned by a service
+// lookup: Host is the SRV target's hostname and IP its resolved address
+// (A or AAAA, depending on family preference and availability), with the
+// priority and weight it was selected under (RFC 2782) preserved so
+// callers can inspect or re-rank the result. Meta holds any Consul
+// node-metadata TXT records returned alongside the target, keyed by
+// metadata key.
+type ServiceInstance struct {
+	Host     string
+	IP       net.IP
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	Meta     map[string]string
 }
@@ -0,0 +1,120 @@
+package servicediscovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// NewServiceDiscoveryDoT builds a ServiceDiscovery that speaks DNS-over-TLS
+// to server (host:port), verifying its certificate against serverName, so
+// operators can point at a Consul cluster exposed over DoT instead of
+// plain UDP/TCP.
+func NewServiceDiscoveryDoT(server string, serverName string, search string) (ServiceDiscovery, error) {
+	ret := serviceDiscovery{
+		servers: []string{server},
+		dnsSearch: search,
+		client: newDoTClient(serverName),
+		targetCache: newTTLCache(),
+		srvCache: newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+	return &ret, nil
+}
+
+// NewServiceDiscoveryDoH builds a ServiceDiscovery that resolves over DNS
+// over HTTPS (RFC 8484) against url, so operators can point at a hardened
+// resolver that only accepts DoH queries.
+func NewServiceDiscoveryDoH(url string, search string) (ServiceDiscovery, error) {
+	ret := serviceDiscovery{
+		servers: []string{url},
+		dnsSearch: search,
+		client: newDoHClient(url),
+		targetCache: newTTLCache(),
+		srvCache: newTTLCache(),
+		maxNegativeTTL: defaultMaxNegativeTTL}
+	return &ret, nil
+}
+
+// dotClient implements DnsClient over DNS-over-TLS (RFC 7858), via
+// dns.Client's built-in "tcp-tls" network.
+type dotClient struct {
+	client *dns.Client
+}
+
+func newDoTClient(serverName string) *dotClient {
+	return &dotClient{client: &dns.Client{
+		Net:       "tcp-tls",
+		TLSConfig: &tls.Config{ServerName: serverName}}}
+}
+
+func (c *dotClient) Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.client.Exchange(m, address)
+}
+
+func (c *dotClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.client.ExchangeContext(ctx, m, address)
+}
+
+// dohClient implements DnsClient over DNS-over-HTTPS (RFC 8484), POSTing
+// the wire-format query as application/dns-message to a fixed URL.
+type dohClient struct {
+	url        string
+	httpClient *http.Client
+}
+
+func newDoHClient(url string) *dohClient {
+	return &dohClient{url: url, httpClient: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (c *dohClient) Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.exchange(context.Background(), m)
+}
+
+func (c *dohClient) ExchangeContext(ctx context.Context, m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.exchange(ctx, m)
+}
+
+func (c *dohClient) exchange(ctx context.Context, m *dns.Msg) (r *dns.Msg, rtt time.Duration, err error) {
+
+	start := time.Now()
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Since(start), fmt.Errorf("DoH query failed: unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+
+	r = new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, time.Since(start), err
+	}
+
+	return r, time.Since(start), nil
+}
@@ -0,0 +1,81 @@
+package servicediscovery
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoHClient_Exchange_PostsPackedQueryToURL(t *testing.T) {
+	a := assert.New(t)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	response := new(dns.Msg)
+	response.SetReply(query)
+	response.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA}}}
+	packedResponse, err := response.Pack()
+	a.NoError(err)
+
+	var gotMethod, gotPath, gotContentType, gotAccept string
+	var gotBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotPath = r.URL.Path
+		gotContentType = r.Header.Get("Content-Type")
+		gotAccept = r.Header.Get("Accept")
+		gotBody, _ = ioutil.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packedResponse)
+	}))
+	defer server.Close()
+
+	testSubject := newDoHClient(server.URL + "/dns-query")
+
+	r, _, err := testSubject.Exchange(query, "")
+
+	a.NoError(err)
+	a.Equal(http.MethodPost, gotMethod)
+	a.Equal("/dns-query", gotPath)
+	a.Equal("application/dns-message", gotContentType)
+	a.Equal("application/dns-message", gotAccept)
+
+	packedQuery, err := query.Pack()
+	a.NoError(err)
+	a.Equal(packedQuery, gotBody)
+
+	a.Len(r.Answer, 1)
+}
+
+func TestDoHClient_Exchange_ReturnsErrorOnNonOKStatus(t *testing.T) {
+	a := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	testSubject := newDoHClient(server.URL)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	_, _, err := testSubject.Exchange(query, "")
+
+	a.Error(err)
+}
+
+func TestNewDoTClient_ConfiguresTLSOverTCP(t *testing.T) {
+	a := assert.New(t)
+
+	testSubject := newDoTClient("consul.example.com")
+
+	a.Equal("tcp-tls", testSubject.client.Net)
+	a.Equal("consul.example.com", testSubject.client.TLSConfig.ServerName)
+}